@@ -3,94 +3,57 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/http/httptrace"
 	"net/url"
 	"os"
-	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
 )
 
 
-type DistributedLock struct {
-	Key        string
-	Value      string
-	LeaseID    clientv3.LeaseID
-	etcdClient *clientv3.Client
-}
-
-type Server struct{
-	Address *url.URL
-	Latitude float64
-	Longitude float64
-	
-}
-
-func (dl *DistributedLock) Lock(ctx context.Context, ttl int64) error {
-
-
-	lease, err := dl.etcdClient.Grant(ctx, ttl)
-
-	if err != nil {
-		return err
-	}
-
-	resp, err := dl.etcdClient.Txn(ctx).
-	If(clientv3.Compare(clientv3.Version(dl.Key), "=", 0)).
-		Then(clientv3.OpPut(dl.Key, dl.Value, clientv3.WithLease(lease.ID))).
-		Commit()
-
-	if err != nil {
-		fmt.Printf("Lock already taken")
-		return err
-	}
-
-	if !resp.Succeeded{
-		return errors.New("error acquring lock")
-	}
-
-	dl.LeaseID = lease.ID
-	log.Printf("Lock acquired: %s", dl.Key)
-	return nil
+type LoadBalancer struct {
+	servers     []*Server
+	mutex       sync.Mutex
+	router      Router
+	geoResolver *GeoIPResolver
+	logger      *zap.Logger
 }
 
-func (dl *DistributedLock) Unlock(ctx context.Context) error {
-	_, err := dl.etcdClient.Delete(ctx, dl.Key)
-	if err != nil {
-		return err
-	}
-
-	_, err = dl.etcdClient.Revoke(ctx, dl.LeaseID)
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Lock released: %s", dl.Key)
-	return nil
+// NewLoadBalancer builds a LoadBalancer that routes through router,
+// logging through logger.
+func NewLoadBalancer(router Router, logger *zap.Logger) *LoadBalancer {
+	return &LoadBalancer{router: router, logger: logger}
 }
 
-
-type LoadBalancer struct {
-	servers []Server
-	mutex   sync.Mutex
+// SetGeoIPResolver enables IP-based client location resolution. Without
+// one, handleRequest only trusts the Latitude/Longitude headers.
+func (lb *LoadBalancer) SetGeoIPResolver(resolver *GeoIPResolver) {
+	lb.geoResolver = resolver
 }
 
 type Location struct{
 	Latitude float64
 	Longitude float64
+	City string
+	Country string
+	Continent string
 }
 
 type Tuple struct{
 	distance float64
-	server Server
+	server *Server
 }
 func degToRad(deg float64) float64 {
 	return deg * (math.Pi / 180)
@@ -116,110 +79,183 @@ func Harvsine(serverLocation Location,requestLocation Location)float64{
 
 }
 
-func (lb *LoadBalancer) DistanceCalculator(requestLocation Location)[]Tuple{
-	
-	distanceServerMap := []Tuple{}
-	
-	for _,server := range lb.servers{
-		serverLocation := Location{server.Latitude,server.Longitude}
-		distance := Harvsine(serverLocation,requestLocation)
-		distanceServerMap = append(distanceServerMap, Tuple{server: server,distance: distance})
+// nextServer asks the configured Router to pick among the currently
+// healthy backends. It returns an error instead of a zero-value URL when
+// nothing is available, so callers can't silently proxy to an empty
+// address.
+func (lb *LoadBalancer) nextServer(routeCtx RouteContext) (*Server, error) {
+	lb.mutex.Lock()
+	servers := make([]*Server, len(lb.servers))
+	copy(servers, lb.servers)
+	lb.mutex.Unlock()
+
+	healthy := make([]*Server, 0, len(servers))
+	for _, s := range servers {
+		if s.isHealthy() {
+			healthy = append(healthy, s)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, errors.New("no healthy backend servers available")
 	}
 
-	sort.Slice(distanceServerMap,func(i, j int) bool {
-		return distanceServerMap[i].distance < distanceServerMap[j].distance
-	})
-
-	return distanceServerMap
+	return lb.router.Route(healthy, routeCtx)
 }
 
-func (lb *LoadBalancer) nextServer(requestLocation Location) *url.URL {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-	serverDistanceMap := lb.DistanceCalculator(requestLocation)
-
-	for _,val := range serverDistanceMap{
-		address := val.server.Address
-		running,_ := lb.checkHealth(address.String())
-		if !running{
-			return address
+func (lb *LoadBalancer) handleRequest(w http.ResponseWriter, r *http.Request) {
+	location := lb.resolveLocation(r)
+	clientIPAddr := clientIP(r)
+	routeCtx := RouteContext{
+		Location: location,
+		ClientIP: clientIPAddr,
+		CoordHdr: r.Header.Get("X-Coord"),
+	}
+	server, err := lb.nextServer(routeCtx)
+	if err != nil {
+		lb.logger.Warn("no backend available for request", zap.String("client_ip", clientIPAddr), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	lb.logger.Info("routing request",
+		zap.String("client_ip", clientIPAddr),
+		zap.Float64("lat", location.Latitude),
+		zap.String("backend", server.Address.String()),
+	)
+	requestsTotal.WithLabelValues(location.Country, location.Continent, server.Address.String()).Inc()
+
+	proxy := httputil.NewSingleHostReverseProxy(server.Address)
+	proxy.Transport = server.transport
+	proxy.ErrorLog = zap.NewStdLog(lb.logger)
+
+	if observer, ok := lb.router.(RTTObserver); ok {
+		// GotConn fires for both a fresh dial and a connection handed back
+		// out of server.transport's keep-alive pool, unlike ConnectStart,
+		// which only fires when a new connection is dialed and would
+		// otherwise starve the router of samples in steady-state traffic.
+		var gotConn, firstByte time.Time
+		trace := &httptrace.ClientTrace{
+			GotConn:              func(httptrace.GotConnInfo) { gotConn = time.Now() },
+			GotFirstResponseByte: func() { firstByte = time.Now() },
 		}
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+		defer func() {
+			if !gotConn.IsZero() && !firstByte.IsZero() {
+				rtt := firstByte.Sub(gotConn)
+				observer.Observe(server, rtt)
+				lb.logger.Debug("observed backend rtt", zap.String("backend", server.Address.String()), zap.Duration("rtt", rtt))
+			}
+		}()
 	}
-	// To be implemented Here if all severs fail
-	return &url.URL{}
+
+	proxy.ServeHTTP(w, r)
 }
 
-func (lb *LoadBalancer) handleRequest(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("request is coming")
-	lat,_ := strconv.ParseFloat(r.Header.Get("Latitude"), 64)
-	long,_ := strconv.ParseFloat(r.Header.Get("Longitude"), 64)
-	requestLocation := Location {
-		Latitude : lat,
-		Longitude: long,
+// resolveLocation prefers GeoIP (when configured) over the
+// Latitude/Longitude headers, which any client can spoof. It falls back to
+// the headers when GeoIP is unavailable or the lookup fails, e.g. for a
+// private client IP.
+func (lb *LoadBalancer) resolveLocation(r *http.Request) Location {
+	if lb.geoResolver != nil {
+		if loc, err := lb.geoResolver.Resolve(r); err == nil {
+			return loc
+		}
 	}
-	server := lb.nextServer(requestLocation)
-	// Reverse proxy to the selected backend server
-	proxy := httputil.NewSingleHostReverseProxy(server)
-	proxy.ServeHTTP(w, r)
+
+	lat, _ := strconv.ParseFloat(r.Header.Get("Latitude"), 64)
+	long, _ := strconv.ParseFloat(r.Header.Get("Longitude"), 64)
+	return Location{Latitude: lat, Longitude: long}
 }
 
-func (lb *LoadBalancer) start(dl DistributedLock,ctx context.Context){
+// clientIP returns the request's remote IP without the port, ignoring any
+// forwarding headers. Trusted-proxy-aware resolution lives in
+// resolveClientIP, used by GeoIPResolver.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
+// start campaigns for leadership and, each time it wins, serves on address
+// until it loses leadership (a newer leader is observed, or its own etcd
+// session expires), at which point it shuts the listener down and goes
+// back to standby. It only returns once ctx is done.
+func (lb *LoadBalancer) start(ctx context.Context, elector *LeaderElector, address string, handler http.Handler) error {
 	for {
-		
-		// Acquire the lock
-		err := dl.Lock(ctx, 20) // Set TTL to 10 seconds
-		if err != nil {
-			fmt.Println("unable to acuire the lock because it is being used")
+		if err := elector.Campaign(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lb.logger.Warn("campaign failed, retrying", zap.Error(err))
+			time.Sleep(time.Second)
 			continue
 		}
 
-		activeServerLocation := dl.Value
-		isActive, _ := lb.checkHealth(activeServerLocation)
-		
-		if !isActive{
-			// If active server returns False, start listening at the active port
-			lb.startListening(activeServerLocation)
-			break
-		} 
-
-		time.Sleep(time.Second * 10)
-		errs := dl.Unlock(ctx) 
-		if errs != nil {
-			fmt.Println("Failed to Unlock")
+		lb.logger.Info("elected leader", zap.String("address", address))
+		server := lb.startListening(address, handler)
+		lb.waitForLeadershipLoss(ctx, elector)
+		lb.stopListening(server)
+		lb.logger.Info("lost leadership, standing by")
+
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 	}
 }
-func (lb *LoadBalancer) checkHealth(address string)(bool,error){
-	conn, err := net.DialTimeout("tcp", address, 1*time.Second)
-	if err != nil {
-		return false,err
+
+// waitForLeadershipLoss blocks until the elector reports we're no longer
+// leader, or ctx is done.
+func (lb *LoadBalancer) waitForLeadershipLoss(ctx context.Context, elector *LeaderElector) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-elector.Observe():
+			if !ok || !event.IsLeader {
+				return
+			}
+		}
 	}
+}
 
-	conn.Close()
-	return true,err
+// startListening runs an http.Server for handler on a background
+// goroutine so it can be gracefully shut down on a leadership flip,
+// instead of the fire-and-forget http.ListenAndServe this replaces.
+func (lb *LoadBalancer) startListening(address string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: address, Handler: handler, ErrorLog: zap.NewStdLog(lb.logger)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lb.logger.Error("listener error", zap.Error(err))
+		}
+	}()
+	return server
 }
-func (lb *LoadBalancer) startListening(address string){
-	http.ListenAndServe(address, nil)
+
+func (lb *LoadBalancer) stopListening(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		lb.logger.Error("error shutting down listener", zap.Error(err))
+	}
 }
 
 func main() {
-	lb := &LoadBalancer{
-		servers: []Server{
-			Server{
-				Address:   parseURL("http://localhost:3030"),
-				Latitude:  10.5,
-				Longitude: 20.6,
-			},
-			Server{
-				Address:   parseURL("http://localhost:3031"),
-				Latitude:  70.5,
-				Longitude: 46.5,
-			},
-		},
-	
+	routerFlag := flag.String("router", "geo", "routing strategy: geo or vivaldi")
+	geoipDBFlag := flag.String("geoip-db", "", "path to a GeoIP2/GeoLite2 City MMDB; empty disables GeoIP resolution")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "comma-separated CIDRs trusted to set X-Forwarded-For/Forwarded")
+	logLevelFlag := flag.String("log-level", "info", "log level: debug, info, warn, error")
+	logFormatFlag := flag.String("log-format", "json", "log format: json or console")
+	replicaIDFlag := flag.String("replica-id", "", "identifies this replica's Vivaldi coordinate space in etcd; defaults to the hostname")
+	flag.Parse()
+
+	logger, err := newLogger(*logLevelFlag, *logFormatFlag)
+	if err != nil {
+		fmt.Printf("Error configuring logger: %v", err)
+		os.Exit(1)
 	}
-	http.HandleFunc("/", lb.handleRequest)
+	defer logger.Sync()
 
 	endpoints := []string{"localhost:2379"}
 
@@ -228,26 +264,55 @@ func main() {
 		DialTimeout: 5 * time.Second,
 	}
 
-	client, err := clientv3.New(cfg)
+	etcdClient, err := NewReconnectingEtcdClient(cfg, logger)
 	if err != nil {
-		fmt.Printf("Error connecting to etcd: %v", err)
-		os.Exit(1)
+		logger.Fatal("error connecting to etcd", zap.Error(err))
+	}
+	defer etcdClient.Close()
+
+	var router Router
+	switch *routerFlag {
+	case "vivaldi":
+		replicaID := *replicaIDFlag
+		if replicaID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				logger.Fatal("error determining replica id", zap.Error(err))
+			}
+			replicaID = hostname
+		}
+		router = NewVivaldiRouter(etcdClient.Client(), replicaID)
+	default:
+		router = &GeoRouter{}
 	}
 
-	defer client.Close()
+	lb := NewLoadBalancer(router, logger)
+	lb.AddServer(NewServer(parseURL("http://localhost:3030"), 10.5, 20.6), defaultHealthCheckInterval)
+	lb.AddServer(NewServer(parseURL("http://localhost:3031"), 70.5, 46.5), defaultHealthCheckInterval)
 
-	ctx := context.Background()
-	lockKey := "active-sever-address"
-	lockValue := ":8080"
+	if *geoipDBFlag != "" {
+		trustedProxies := strings.Split(*trustedProxiesFlag, ",")
+		resolver, err := NewGeoIPResolver(*geoipDBFlag, trustedProxies, 0)
+		if err != nil {
+			logger.Warn("error loading GeoIP database", zap.Error(err))
+		} else {
+			lb.SetGeoIPResolver(resolver)
+			defer resolver.Close()
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", lb.handleRequest)
+	mux.Handle("/metrics", promhttp.Handler())
 
-	dl := DistributedLock{
-		Key:        lockKey,
-		Value:      lockValue,
-		etcdClient: client,
-	}	
-	
-	lb.start(dl,ctx)
+	const listenAddress = ":8080"
+	elector := NewLeaderElector(etcdClient, "/lb/election", listenAddress, logger)
+	defer elector.Close()
 
+	ctx := context.Background()
+	if err := lb.start(ctx, elector, listenAddress, mux); err != nil {
+		logger.Error("load balancer stopped", zap.Error(err))
+	}
 }
 
 func parseURL(rawURL string) *url.URL {
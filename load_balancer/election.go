@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	rpctypes "go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+)
+
+// ReconnectingEtcdClient wraps a clientv3.Client so it can be rebuilt from
+// the same config. LeaderElector.Campaign rebuilds it when a session or
+// campaign fails with an error that means the underlying gRPC connection
+// (and any session built on it) is no longer good. Calls made directly on
+// the client returned by Client are neither retried nor reconnected.
+type ReconnectingEtcdClient struct {
+	cfg    clientv3.Config
+	logger *zap.Logger
+
+	mu     sync.RWMutex
+	client *clientv3.Client
+}
+
+// NewReconnectingEtcdClient dials etcd using cfg, keeping cfg around so the
+// client can be rebuilt later with the same settings.
+func NewReconnectingEtcdClient(cfg clientv3.Config, logger *zap.Logger) (*ReconnectingEtcdClient, error) {
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ReconnectingEtcdClient{cfg: cfg, logger: logger, client: client}, nil
+}
+
+// Client returns the current underlying client. It may be swapped out from
+// under the caller by a concurrent reconnect, so callers shouldn't hold on
+// to it across a session-affecting error.
+func (r *ReconnectingEtcdClient) Client() *clientv3.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client
+}
+
+// NewSession opens a new concurrency.Session against the current client.
+func (r *ReconnectingEtcdClient) NewSession() (*concurrency.Session, error) {
+	return concurrency.NewSession(r.Client())
+}
+
+// reconnect closes the current client and dials a fresh one from the same
+// config, e.g. after the server told us its leader changed out from under
+// an in-flight request.
+func (r *ReconnectingEtcdClient) reconnect() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.client.Close()
+	client, err := clientv3.New(r.cfg)
+	if err != nil {
+		r.logger.Error("etcd reconnect failed", zap.Error(err))
+		return err
+	}
+	r.logger.Warn("reconnected to etcd", zap.Strings("endpoints", r.cfg.Endpoints))
+	r.client = client
+	return nil
+}
+
+// shouldReconnect reports whether err indicates the connection itself
+// needs rebuilding rather than a session-level retry.
+func shouldReconnect(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, rpctypes.ErrGRPCLeaderChanged) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+func (r *ReconnectingEtcdClient) Close() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Close()
+}
+
+// LeaderEvent reports a leadership change observed on the election prefix.
+type LeaderEvent struct {
+	IsLeader bool
+	Leader   string
+}
+
+// LeaderElector campaigns for leadership of a single election prefix and
+// reports every observed leadership change, including our own session
+// expiring (e.g. because etcd was unreachable long enough for the lease to
+// lapse). It holds up under a reconnecting etcd client by rebuilding its
+// session whenever Campaign fails for a connection-level reason.
+type LeaderElector struct {
+	client *ReconnectingEtcdClient
+	prefix string
+	value  string
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	session  *concurrency.Session
+	election *concurrency.Election
+	events   chan LeaderEvent
+
+	// watching is the session watch and monitorSession are currently
+	// running for, or nil. It guards against spawning a second pair of
+	// goroutines when Campaign wins another term on a session that's
+	// still alive from the last one.
+	watching *concurrency.Session
+}
+
+// NewLeaderElector prepares a LeaderElector for the given election prefix.
+// value identifies this node (e.g. the address it will listen on) and is
+// what Observe reports back as the elected Leader.
+func NewLeaderElector(client *ReconnectingEtcdClient, prefix, value string, logger *zap.Logger) *LeaderElector {
+	return &LeaderElector{
+		client: client,
+		prefix: prefix,
+		value:  value,
+		logger: logger,
+		events: make(chan LeaderEvent, 1),
+	}
+}
+
+// Campaign blocks until this node becomes the leader, reconnecting the
+// underlying etcd client and retrying when the campaign fails for a
+// connection-level reason. Once elected, it starts watching the election
+// for changes and monitoring its own session for unexpected expiry.
+func (le *LeaderElector) Campaign(ctx context.Context) error {
+	for {
+		if err := le.ensureSession(); err != nil {
+			if !shouldReconnect(err) {
+				return err
+			}
+			if err := le.client.reconnect(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		election, session := le.currentElection()
+		err := election.Campaign(ctx, le.value)
+		if err == nil {
+			le.logger.Info("leader elected", zap.String("key", le.prefix), zap.String("value", le.value), zap.Int64("lease", int64(session.Lease())))
+			le.events <- LeaderEvent{IsLeader: true, Leader: le.value}
+			le.beginWatching(ctx, election, session)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !shouldReconnect(err) {
+			return err
+		}
+		if err := le.client.reconnect(); err != nil {
+			return err
+		}
+		le.invalidateSession()
+	}
+}
+
+// Resign gives up leadership without closing the session, so the node can
+// campaign again later.
+func (le *LeaderElector) Resign(ctx context.Context) error {
+	election, _ := le.currentElection()
+	if election == nil {
+		return nil
+	}
+	le.logger.Info("resigning leadership", zap.String("key", le.prefix), zap.String("value", le.value))
+	return election.Resign(ctx)
+}
+
+// Observe returns the channel of leadership changes: our own election
+// result, leadership moving to another node, and our session expiring.
+func (le *LeaderElector) Observe() <-chan LeaderEvent {
+	return le.events
+}
+
+// Close releases the current session, resigning any held leadership.
+func (le *LeaderElector) Close() error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if le.session == nil {
+		return nil
+	}
+	return le.session.Close()
+}
+
+func (le *LeaderElector) ensureSession() error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if le.session != nil {
+		select {
+		case <-le.session.Done():
+		default:
+			return nil
+		}
+	}
+
+	session, err := le.client.NewSession()
+	if err != nil {
+		return err
+	}
+	le.session = session
+	le.election = concurrency.NewElection(session, le.prefix)
+	return nil
+}
+
+func (le *LeaderElector) invalidateSession() {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.session = nil
+	le.election = nil
+}
+
+func (le *LeaderElector) currentElection() (*concurrency.Election, *concurrency.Session) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.election, le.session
+}
+
+// beginWatching starts watch and monitorSession for session, unless they're
+// already running for it, e.g. because Campaign won a second term on a
+// session that was never invalidated between the two. Without this guard,
+// every re-election on a still-live session would leak another pair of
+// goroutines and double up the LeaderEvents they send.
+func (le *LeaderElector) beginWatching(ctx context.Context, election *concurrency.Election, session *concurrency.Session) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if le.watching == session {
+		return
+	}
+	le.watching = session
+	go le.watch(ctx, election)
+	go le.monitorSession(session)
+}
+
+// watch relays every leadership change on the election prefix until ctx is
+// done or the underlying watch channel closes.
+func (le *LeaderElector) watch(ctx context.Context, election *concurrency.Election) {
+	for resp := range election.Observe(ctx) {
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+		leader := string(resp.Kvs[0].Value)
+		le.logger.Info("leadership change observed", zap.String("key", le.prefix), zap.String("leader", leader), zap.Bool("is_leader", leader == le.value))
+		le.events <- LeaderEvent{IsLeader: leader == le.value, Leader: leader}
+	}
+}
+
+// monitorSession reports a leadership loss the moment our session's
+// keep-alive stops, e.g. because etcd was unreachable long enough for the
+// lease to expire out from under us.
+func (le *LeaderElector) monitorSession(session *concurrency.Session) {
+	<-session.Done()
+	le.logger.Warn("etcd session expired, leadership lost", zap.String("key", le.prefix), zap.Int64("lease", int64(session.Lease())))
+	le.events <- LeaderEvent{IsLeader: false}
+}
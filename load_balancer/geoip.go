@@ -0,0 +1,227 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+const defaultGeoCacheSize = 4096
+
+// GeoIPResolver resolves a request's client location from its IP instead
+// of trusting client-supplied Latitude/Longitude headers. It only trusts
+// X-Forwarded-For/Forwarded when the immediate peer is in trustedProxies,
+// and caches lookups by /24 (IPv4) or /48 (IPv6) prefix to avoid a DB hit
+// per request.
+type GeoIPResolver struct {
+	db             *geoip2.Reader
+	trustedProxies []*net.IPNet
+	cache          *geoLRU
+}
+
+// NewGeoIPResolver opens the MMDB at dbPath and parses trustedCIDRs as the
+// set of proxies allowed to set forwarding headers. cacheSize <= 0 uses
+// defaultGeoCacheSize.
+func NewGeoIPResolver(dbPath string, trustedCIDRs []string, cacheSize int) (*GeoIPResolver, error) {
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies := make([]*net.IPNet, 0, len(trustedCIDRs))
+	for _, raw := range trustedCIDRs {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(raw)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		proxies = append(proxies, ipnet)
+	}
+
+	return &GeoIPResolver{db: db, trustedProxies: proxies, cache: newGeoLRU(cacheSize)}, nil
+}
+
+func (gr *GeoIPResolver) Close() error {
+	return gr.db.Close()
+}
+
+// Resolve returns the caller's Location, failing for private/loopback IPs
+// and anything the GeoIP DB has no record for, so handleRequest can fall
+// back to the header-based path.
+func (gr *GeoIPResolver) Resolve(r *http.Request) (Location, error) {
+	ip := resolveClientIP(r, gr.trustedProxies)
+	if ip == nil {
+		return Location{}, errors.New("geoip: could not determine client ip")
+	}
+	if ip.IsLoopback() || ip.IsPrivate() {
+		return Location{}, errors.New("geoip: client ip is private")
+	}
+
+	key := geoCacheKey(ip)
+	if loc, ok := gr.cache.Get(key); ok {
+		return loc, nil
+	}
+
+	record, err := gr.db.City(ip)
+	if err != nil {
+		return Location{}, err
+	}
+	// City returns an empty record, not an error, for an IP the DB has no
+	// entry for.
+	if record.Country.IsoCode == "" && record.Location.Latitude == 0 && record.Location.Longitude == 0 {
+		return Location{}, errors.New("geoip: no record for client ip")
+	}
+
+	loc := Location{
+		Latitude:  record.Location.Latitude,
+		Longitude: record.Location.Longitude,
+		City:      record.City.Names["en"],
+		Country:   record.Country.Names["en"],
+		Continent: record.Continent.Names["en"],
+	}
+	gr.cache.Put(key, loc)
+	return loc, nil
+}
+
+// geoCacheKey collapses an IP down to its /24 (IPv4) or /48 (IPv6) prefix
+// so nearby addresses share a cache entry.
+func geoCacheKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// resolveClientIP returns the remote peer's IP. When the peer itself is a
+// trusted proxy, it returns instead the for= IP of the first Forwarded
+// element if there is one, else the right-most untrusted hop in
+// X-Forwarded-For.
+func resolveClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	remote := hostIP(r.RemoteAddr)
+	if remote == nil || !isTrustedProxy(remote, trustedProxies) {
+		return remote
+	}
+
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		if ip := parseForwardedHeader(fwd); ip != nil {
+			return ip
+		}
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				continue
+			}
+			if !isTrustedProxy(ip, trustedProxies) {
+				return ip
+			}
+		}
+	}
+
+	return remote
+}
+
+func hostIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedHeader extracts the "for=" IP from the first element of an
+// RFC 7239 Forwarded header, stripping the IPv6 bracket/port form.
+func parseForwardedHeader(header string) net.IP {
+	first := strings.Split(header, ",")[0]
+	for _, field := range strings.Split(first, ";") {
+		field = strings.TrimSpace(field)
+		if !strings.HasPrefix(strings.ToLower(field), "for=") {
+			continue
+		}
+		value := strings.Trim(field[len("for="):], `"`)
+		value = strings.TrimPrefix(value, "[")
+		if idx := strings.Index(value, "]"); idx != -1 {
+			value = value[:idx]
+		} else if idx := strings.LastIndex(value, ":"); idx != -1 && strings.Count(value, ":") == 1 {
+			value = value[:idx]
+		}
+		return net.ParseIP(value)
+	}
+	return nil
+}
+
+type geoLRUEntry struct {
+	key string
+	loc Location
+}
+
+// geoLRU is a small fixed-capacity LRU cache mapping an IP prefix to a
+// resolved Location, avoiding a GeoIP DB hit per request.
+type geoLRU struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newGeoLRU(capacity int) *geoLRU {
+	if capacity <= 0 {
+		capacity = defaultGeoCacheSize
+	}
+	return &geoLRU{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *geoLRU) Get(key string) (Location, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Location{}, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*geoLRUEntry).loc, true
+}
+
+func (c *geoLRU) Put(key string, loc Location) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*geoLRUEntry).loc = loc
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&geoLRUEntry{key: key, loc: loc})
+	c.items[key] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*geoLRUEntry).key)
+		}
+	}
+}
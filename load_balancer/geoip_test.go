@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", cidr, err)
+	}
+	return ipnet
+}
+
+func TestResolveClientIPUntrustedPeerIgnoresHeaders(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := &http.Request{RemoteAddr: "203.0.113.5:1234", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	got := resolveClientIP(r, trusted)
+	if got.String() != "203.0.113.5" {
+		t.Fatalf("resolveClientIP = %v, want the untrusted peer's own IP", got)
+	}
+}
+
+func TestResolveClientIPTrustedProxyUsesForwardedFor(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+
+	got := resolveClientIP(r, trusted)
+	if got.String() != "198.51.100.7" {
+		t.Fatalf("resolveClientIP = %v, want the right-most untrusted hop", got)
+	}
+}
+
+func TestResolveClientIPTrustedProxySkipsOtherTrustedHops(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.2, 10.0.0.1")
+
+	got := resolveClientIP(r, trusted)
+	if got.String() != "198.51.100.7" {
+		t.Fatalf("resolveClientIP = %v, want to skip past every trusted hop", got)
+	}
+}
+
+func TestResolveClientIPPrefersForwardedOverXForwardedFor(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	r.Header.Set("Forwarded", `for="198.51.100.9"`)
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	got := resolveClientIP(r, trusted)
+	if got.String() != "198.51.100.9" {
+		t.Fatalf("resolveClientIP = %v, want the Forwarded header's IP", got)
+	}
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"simple for", `for=192.0.2.60`, "192.0.2.60"},
+		{"quoted for", `for="192.0.2.60"`, "192.0.2.60"},
+		{"bracketed ipv6 with port", `for="[2001:db8::1]:48"`, "2001:db8::1"},
+		{"multiple params, by before for", `by=203.0.113.1;for=192.0.2.60;proto=http`, "192.0.2.60"},
+		{"multiple elements uses the first", "for=192.0.2.60, for=198.51.100.1", "192.0.2.60"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseForwardedHeader(c.header)
+			if got == nil || got.String() != c.want {
+				t.Errorf("parseForwardedHeader(%q) = %v, want %v", c.header, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseForwardedHeaderMissingFor(t *testing.T) {
+	if got := parseForwardedHeader("by=203.0.113.1;proto=http"); got != nil {
+		t.Errorf("parseForwardedHeader with no for= = %v, want nil", got)
+	}
+}
+
+func TestGeoCacheKeyCollapsesToPrefix(t *testing.T) {
+	a := geoCacheKey(net.ParseIP("198.51.100.7"))
+	b := geoCacheKey(net.ParseIP("198.51.100.250"))
+	if a != b {
+		t.Errorf("geoCacheKey(%q) = %q, geoCacheKey(%q) = %q, want the same /24", "198.51.100.7", a, "198.51.100.250", b)
+	}
+}
+
+func TestGeoLRUEvictsOldest(t *testing.T) {
+	c := newGeoLRU(2)
+	c.Put("a", Location{City: "A"})
+	c.Put("b", Location{City: "B"})
+	c.Put("c", Location{City: "C"}) // evicts "a", the least recently used
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected \"a\" to have been evicted")
+	}
+	if loc, ok := c.Get("b"); !ok || loc.City != "B" {
+		t.Errorf("Get(\"b\") = %v, %v, want City=B, true", loc, ok)
+	}
+	if loc, ok := c.Get("c"); !ok || loc.City != "C" {
+		t.Errorf("Get(\"c\") = %v, %v, want City=C, true", loc, ok)
+	}
+}
+
+func TestGeoLRUGetRefreshesRecency(t *testing.T) {
+	c := newGeoLRU(2)
+	c.Put("a", Location{City: "A"})
+	c.Put("b", Location{City: "B"})
+	c.Get("a")                      // touch "a" so "b" becomes the least recently used
+	c.Put("c", Location{City: "C"}) // evicts "b", not "a"
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected \"b\" to have been evicted after \"a\" was refreshed")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("expected \"a\" to survive eviction after being refreshed")
+	}
+}
+
+func TestGeoLRUDefaultsCapacity(t *testing.T) {
+	c := newGeoLRU(0)
+	if c.capacity != defaultGeoCacheSize {
+		t.Errorf("capacity = %d, want default %d", c.capacity, defaultGeoCacheSize)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger builds the process-wide zap.Logger from --log-level/--log-format.
+// Its core is wrapped in a sampler so a backend flapping health checks
+// can't drown the log in identical "health check failed" lines.
+func newLogger(level, format string) (*zap.Logger, error) {
+	var zapLevel zapcore.Level
+	if err := zapLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	var encoder zapcore.Encoder
+	switch format {
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	case "json", "":
+		encoderCfg := zap.NewProductionEncoderConfig()
+		encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+		encoder = zapcore.NewJSONEncoder(encoderCfg)
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be json or console", format)
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.Lock(os.Stdout), zapLevel)
+	sampled := zapcore.NewSamplerWithOptions(core, time.Second, 5, 50)
+
+	return zap.New(sampled, zap.AddCaller()), nil
+}
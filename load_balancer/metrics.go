@@ -0,0 +1,16 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// requestsTotal tracks proxied requests labeled by resolved geography and
+// chosen backend, so operators can see geographic routing behavior. City is
+// deliberately excluded: GeoIP resolves arbitrarily many distinct cities,
+// and a label on raw city would give this metric unbounded cardinality.
+var requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "lb_requests_total",
+	Help: "Total proxied requests, labeled by resolved client geography and chosen backend.",
+}, []string{"country", "continent", "backend"})
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// RouteContext carries everything a Router might need to pick a backend
+// for a single request: the caller's physical location (GeoRouter) and
+// enough to resolve a network coordinate (VivaldiRouter).
+type RouteContext struct {
+	Location Location
+	ClientIP string
+	CoordHdr string
+}
+
+// Router chooses a backend among the currently healthy servers. Different
+// implementations order servers by different notions of "closeness".
+type Router interface {
+	Route(servers []*Server, routeCtx RouteContext) (*Server, error)
+}
+
+// RTTObserver is implemented by routers that learn from measured
+// round-trip times to the backends they route to.
+type RTTObserver interface {
+	Observe(server *Server, rtt time.Duration)
+}
+
+// ServerAwareRouter is implemented by routers that need to initialize
+// per-server state (e.g. a Vivaldi coordinate) when a backend joins.
+type ServerAwareRouter interface {
+	OnServerAdded(server *Server)
+}
+
+// GeoRouter orders backends by haversine distance between the server's
+// configured lat/long and the request's location. This is the original
+// routing behaviour of LoadBalancer.nextServer, lifted behind Router.
+type GeoRouter struct{}
+
+func (g *GeoRouter) Route(servers []*Server, routeCtx RouteContext) (*Server, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no servers to route to")
+	}
+
+	tuples := make([]Tuple, 0, len(servers))
+	for _, s := range servers {
+		d := Harvsine(Location{Latitude: s.Latitude, Longitude: s.Longitude}, routeCtx.Location)
+		tuples = append(tuples, Tuple{server: s, distance: d})
+	}
+	sort.Slice(tuples, func(i, j int) bool {
+		return tuples[i].distance < tuples[j].distance
+	})
+
+	return tuples[0].server, nil
+}
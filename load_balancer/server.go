@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckPath     = "/healthz"
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// Server represents a single backend behind the load balancer. Health and
+// the set of in-flight connections are guarded by mu so the background
+// health checker and the request path can touch them concurrently.
+type Server struct {
+	Address   *url.URL
+	Latitude  float64
+	Longitude float64
+
+	healthCheckPath string
+	healthCheck     func() bool
+	stopCh          chan struct{}
+
+	// Coord is this backend's Vivaldi network coordinate. It's nil unless
+	// the LoadBalancer is using a VivaldiRouter.
+	Coord *Coordinate
+
+	// transport is built once per Server and reused across requests so
+	// keep-alive connections actually get pooled, instead of paying a
+	// fresh handshake (and leaking a Transport) on every proxied request.
+	transport *http.Transport
+
+	mu          sync.Mutex
+	healthy     bool
+	connections map[net.Conn]struct{}
+}
+
+// NewServer builds a Server with the default HTTP-with-TCP-fallback health
+// check and starts it out healthy so it's eligible for traffic until the
+// first check says otherwise.
+func NewServer(address *url.URL, latitude, longitude float64) *Server {
+	s := &Server{
+		Address:         address,
+		Latitude:        latitude,
+		Longitude:       longitude,
+		healthCheckPath: defaultHealthCheckPath,
+		stopCh:          make(chan struct{}),
+		healthy:         true,
+		connections:     make(map[net.Conn]struct{}),
+	}
+	s.healthCheck = s.defaultHealthCheck
+	s.transport = newServerTransport(s)
+	return s
+}
+
+// defaultHealthCheck does an HTTP GET against healthCheckPath and counts
+// any status below 500 as healthy, so a path that isn't wired up yet still
+// passes. It falls back to a plain TCP dial only if the GET itself fails,
+// e.g. because the server doesn't speak HTTP.
+func (s *Server) defaultHealthCheck() bool {
+	client := http.Client{Timeout: defaultHealthCheckTimeout}
+	resp, err := client.Get(s.Address.String() + s.healthCheckPath)
+	if err == nil {
+		resp.Body.Close()
+		return resp.StatusCode < http.StatusInternalServerError
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Address.Host, defaultHealthCheckTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (s *Server) isHealthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.healthy
+}
+
+// setHealthy updates the health flag and reports whether this call just
+// transitioned the server from healthy to unhealthy.
+func (s *Server) setHealthy(healthy bool) (becameUnhealthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	becameUnhealthy = s.healthy && !healthy
+	s.healthy = healthy
+	return becameUnhealthy
+}
+
+func (s *Server) trackConn(conn net.Conn) {
+	s.mu.Lock()
+	s.connections[conn] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.connections, conn)
+	s.mu.Unlock()
+}
+
+// drainConnections closes every connection currently tracked for this
+// server, e.g. because it just went unhealthy or is being removed.
+func (s *Server) drainConnections() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.connections))
+	for conn := range s.connections {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// serverConn wraps a net.Conn dialed for a particular Server so the
+// connection tracks itself for the lifetime of the dial, including
+// connections sitting idle in an http.Transport's keep-alive pool.
+type serverConn struct {
+	net.Conn
+	server *Server
+}
+
+func newServerConn(conn net.Conn, server *Server) *serverConn {
+	sc := &serverConn{Conn: conn, server: server}
+	server.trackConn(sc)
+	return sc
+}
+
+func (c *serverConn) Close() error {
+	c.server.untrackConn(c)
+	return c.Conn.Close()
+}
+
+// AddServer registers a new backend and starts its background health
+// checker on the given interval.
+func (lb *LoadBalancer) AddServer(s *Server, interval time.Duration) {
+	lb.mutex.Lock()
+	lb.servers = append(lb.servers, s)
+	lb.mutex.Unlock()
+
+	if aware, ok := lb.router.(ServerAwareRouter); ok {
+		aware.OnServerAdded(s)
+	}
+	lb.logger.Info("backend added", zap.String("addr", s.Address.String()))
+	lb.monitorServer(s, interval)
+}
+
+// RemoveServer stops health-checking the backend at address, drops it from
+// rotation, and drains any connections it still has in flight.
+func (lb *LoadBalancer) RemoveServer(address *url.URL) {
+	lb.mutex.Lock()
+	var removed *Server
+	remaining := make([]*Server, 0, len(lb.servers))
+	for _, s := range lb.servers {
+		if s.Address.String() == address.String() {
+			removed = s
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	lb.servers = remaining
+	lb.mutex.Unlock()
+
+	if removed == nil {
+		return
+	}
+	close(removed.stopCh)
+	removed.drainConnections()
+	removed.transport.CloseIdleConnections()
+	lb.logger.Info("backend removed", zap.String("addr", address.String()))
+}
+
+// monitorServer runs s.healthCheck on a ticker until stopCh is closed,
+// draining the server's connections the moment it flips unhealthy so
+// clients fail over instead of hanging on a dead backend.
+func (lb *LoadBalancer) monitorServer(s *Server, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				healthy := s.healthCheck()
+				if !healthy {
+					lb.logger.Warn("health check failed", zap.String("addr", s.Address.String()), zap.Bool("healthy", healthy))
+				}
+				if s.setHealthy(healthy) {
+					lb.logger.Info("backend health transition", zap.String("addr", s.Address.String()), zap.Bool("healthy", healthy))
+					s.drainConnections()
+				}
+			}
+		}
+	}()
+}
+
+// newServerTransport builds the one Transport a Server proxies all of its
+// requests through. Its DialContext wraps every connection it opens in a
+// serverConn, so the server's in-flight connection set stays accurate even
+// across pooled keep-alive dials.
+func newServerTransport(server *Server) *http.Transport {
+	dialer := &net.Dialer{Timeout: defaultHealthCheckTimeout}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newServerConn(conn, server), nil
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
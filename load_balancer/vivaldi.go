@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	vivaldiDimensions = 8
+	vivaldiCE         = 0.25
+	vivaldiCC         = 0.25
+	coordEtcdPrefix   = "/lb/coords/"
+)
+
+// Coordinate is a Vivaldi network coordinate: a small Euclidean vector plus
+// a height modeling last-mile latency, and an error estimate in [0, 1]
+// driven down as observed RTTs confirm the coordinate.
+type Coordinate struct {
+	mu     sync.Mutex
+	Vec    []float64
+	Height float64
+	Error  float64
+}
+
+// NewCoordinate returns the Vivaldi origin: zero vector, zero height, and
+// maximum uncertainty, per the reference algorithm's initial state.
+func NewCoordinate() *Coordinate {
+	return &Coordinate{Vec: make([]float64, vivaldiDimensions), Height: 0, Error: 1.0}
+}
+
+type coordSnapshot struct {
+	vec    []float64
+	height float64
+	errVal float64
+}
+
+func (c *Coordinate) snapshot() coordSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vec := make([]float64, len(c.Vec))
+	copy(vec, c.Vec)
+	return coordSnapshot{vec: vec, height: c.Height, errVal: c.Error}
+}
+
+// distanceTo predicts network latency to other: Euclidean distance between
+// the two coordinate vectors plus both sides' last-mile height.
+func (c *Coordinate) distanceTo(other *Coordinate) float64 {
+	a := c.snapshot()
+	b := other.snapshot()
+	return euclidean(a.vec, b.vec) + a.height + b.height
+}
+
+// update applies the standard Vivaldi step to c given a fresh RTT sample
+// to other: relative error es, blended error estimate, and a coordinate
+// move scaled by confidence weight w and step size cc.
+func (c *Coordinate) update(other *Coordinate, rttSeconds float64) {
+	if rttSeconds <= 0 {
+		return
+	}
+	o := other.snapshot()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dist := euclidean(c.Vec, o.vec)
+	w := c.Error / (c.Error + o.errVal)
+	es := math.Abs(dist-rttSeconds) / rttSeconds
+	c.Error = es*vivaldiCE*w + c.Error*(1-vivaldiCE*w)
+	if c.Error > 1 {
+		c.Error = 1
+	}
+
+	delta := vivaldiCC * w
+	unit := unitVector(c.Vec, o.vec)
+	for i := range c.Vec {
+		c.Vec[i] += delta * (rttSeconds - dist) * unit[i]
+	}
+}
+
+func euclidean(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// unitVector returns the unit vector pointing from b to a, or a random
+// unit vector if the two coordinates coincide.
+func unitVector(a, b []float64) []float64 {
+	diff := make([]float64, len(a))
+	norm := 0.0
+	for i := range a {
+		diff[i] = a[i] - b[i]
+		norm += diff[i] * diff[i]
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return randomUnitVector(len(a))
+	}
+	for i := range diff {
+		diff[i] /= norm
+	}
+	return diff
+}
+
+func randomUnitVector(n int) []float64 {
+	v := make([]float64, n)
+	norm := 0.0
+	for i := range v {
+		v[i] = rand.Float64()*2 - 1
+		norm += v[i] * v[i]
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		v[0] = 1
+		return v
+	}
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+// parseCoordHeader parses the X-Coord header format
+// "v1,v2,...,v8;height" into a Coordinate with Error left at the default
+// (maximum uncertainty, since the client doesn't report one).
+func parseCoordHeader(header string) (*Coordinate, error) {
+	parts := strings.SplitN(header, ";", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed X-Coord header: %q", header)
+	}
+
+	fields := strings.Split(parts[0], ",")
+	vec := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed X-Coord vector component %q: %w", f, err)
+		}
+		vec[i] = v
+	}
+
+	height, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed X-Coord height %q: %w", parts[1], err)
+	}
+	if height < 0 {
+		height = 0
+	}
+
+	return &Coordinate{Vec: vec, Height: height, Error: 1.0}, nil
+}
+
+type coordDTO struct {
+	Vec    []float64 `json:"vec"`
+	Height float64   `json:"height"`
+	Error  float64   `json:"error"`
+}
+
+// VivaldiRouter routes to the backend with the shortest predicted network
+// distance from the caller, using synthetic coordinates learned from
+// measured RTTs instead of physical lat/long.
+type VivaldiRouter struct {
+	// local is this proxy's own coordinate, used as the reference point
+	// backend coordinates are updated against on every observed RTT. It
+	// never moves, so it's only a consistent vantage point within a single
+	// replica's own calibration, not across replicas.
+	local *Coordinate
+
+	// replicaID namespaces this replica's persisted coordinates in etcd so
+	// two replicas, which calibrate every backend against their own
+	// distinct (and physically different) local vantage point, don't
+	// overwrite each other's warm-start state with contradictory RTTs.
+	replicaID string
+
+	etcdClient *clientv3.Client
+
+	mu           sync.Mutex
+	clientCoords map[string]*Coordinate
+}
+
+// NewVivaldiRouter builds a VivaldiRouter that persists and warm-starts
+// backend coordinates through etcdClient, namespaced under replicaID so
+// multiple replicas don't stomp on each other's calibration. etcdClient may
+// be nil, in which case coordinates simply aren't persisted across restarts.
+func NewVivaldiRouter(etcdClient *clientv3.Client, replicaID string) *VivaldiRouter {
+	return &VivaldiRouter{
+		local:        NewCoordinate(),
+		replicaID:    replicaID,
+		etcdClient:   etcdClient,
+		clientCoords: make(map[string]*Coordinate),
+	}
+}
+
+// coordKey returns the etcd key this replica persists addr's coordinate
+// under.
+func (r *VivaldiRouter) coordKey(addr string) string {
+	return coordEtcdPrefix + r.replicaID + "/" + addr
+}
+
+// OnServerAdded gives the new backend a coordinate, warm-started from
+// etcd if one was persisted from a previous run.
+func (r *VivaldiRouter) OnServerAdded(server *Server) {
+	server.Coord = NewCoordinate()
+	r.warmStart(server)
+}
+
+// Observe updates a backend's coordinate from a freshly measured RTT and
+// persists the result so a restarted replica warm-starts from it.
+func (r *VivaldiRouter) Observe(server *Server, rtt time.Duration) {
+	if server.Coord == nil || rtt <= 0 {
+		return
+	}
+	server.Coord.update(r.local, rtt.Seconds())
+	go r.persist(server)
+}
+
+// Route returns the backend with the smallest predicted distance from the
+// caller's coordinate, resolved from the X-Coord header or, failing that,
+// a coordinate cached for the caller's IP from a prior request.
+func (r *VivaldiRouter) Route(servers []*Server, routeCtx RouteContext) (*Server, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no servers to route to")
+	}
+
+	coord := r.resolveClientCoord(routeCtx)
+	best := servers[0]
+	bestDist := coord.distanceTo(best.Coord)
+	for _, s := range servers[1:] {
+		if d := coord.distanceTo(s.Coord); d < bestDist {
+			bestDist = d
+			best = s
+		}
+	}
+	return best, nil
+}
+
+func (r *VivaldiRouter) resolveClientCoord(routeCtx RouteContext) *Coordinate {
+	if routeCtx.CoordHdr != "" {
+		if coord, err := parseCoordHeader(routeCtx.CoordHdr); err == nil {
+			r.cacheClientCoord(routeCtx.ClientIP, coord)
+			return coord
+		}
+	}
+	if coord := r.lookupClientCoord(routeCtx.ClientIP); coord != nil {
+		return coord
+	}
+	return r.local
+}
+
+func (r *VivaldiRouter) cacheClientCoord(clientIP string, coord *Coordinate) {
+	if clientIP == "" {
+		return
+	}
+	r.mu.Lock()
+	r.clientCoords[clientIP] = coord
+	r.mu.Unlock()
+}
+
+func (r *VivaldiRouter) lookupClientCoord(clientIP string) *Coordinate {
+	if clientIP == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.clientCoords[clientIP]
+}
+
+func (r *VivaldiRouter) persist(server *Server) {
+	if r.etcdClient == nil {
+		return
+	}
+	snap := server.Coord.snapshot()
+	data, err := json.Marshal(coordDTO{Vec: snap.vec, Height: snap.height, Error: snap.errVal})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r.etcdClient.Put(ctx, r.coordKey(server.Address.String()), string(data))
+}
+
+func (r *VivaldiRouter) warmStart(server *Server) {
+	if r.etcdClient == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := r.etcdClient.Get(ctx, r.coordKey(server.Address.String()))
+	if err != nil || len(resp.Kvs) == 0 {
+		return
+	}
+
+	var dto coordDTO
+	if err := json.Unmarshal(resp.Kvs[0].Value, &dto); err != nil {
+		return
+	}
+	if dto.Height < 0 {
+		dto.Height = 0
+	}
+
+	server.Coord.mu.Lock()
+	server.Coord.Vec = dto.Vec
+	server.Coord.Height = dto.Height
+	server.Coord.Error = dto.Error
+	server.Coord.mu.Unlock()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEuclidean(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"identical points", []float64{1, 2, 3}, []float64{1, 2, 3}, 0},
+		{"3-4-5 triangle across two axes", []float64{0, 0}, []float64{3, 4}, 5},
+		{"negative components", []float64{-1, -1}, []float64{1, 1}, math.Sqrt(8)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := euclidean(c.a, c.b); math.Abs(got-c.want) > 1e-9 {
+				t.Errorf("euclidean(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+			}
+		})
+	}
+}
+
+func TestUnitVectorCoincidentFallsBackToRandom(t *testing.T) {
+	v := unitVector([]float64{1, 2, 3}, []float64{1, 2, 3})
+	if got := euclidean(v, make([]float64, len(v))); math.Abs(got-1) > 1e-9 {
+		t.Fatalf("unitVector for coincident points returned non-unit vector: norm %v", got)
+	}
+}
+
+func TestUnitVectorPointsFromBToA(t *testing.T) {
+	v := unitVector([]float64{3, 0}, []float64{0, 0})
+	want := []float64{1, 0}
+	for i := range want {
+		if math.Abs(v[i]-want[i]) > 1e-9 {
+			t.Fatalf("unitVector({3,0}, {0,0}) = %v, want %v", v, want)
+		}
+	}
+}
+
+func TestRandomUnitVectorIsUnit(t *testing.T) {
+	v := randomUnitVector(vivaldiDimensions)
+	if got := euclidean(v, make([]float64, len(v))); math.Abs(got-1) > 1e-9 {
+		t.Fatalf("randomUnitVector returned norm %v, want 1", got)
+	}
+}
+
+// TestCoordinateUpdateConverges checks that repeatedly applying Vivaldi
+// updates from a fixed reference coordinate at a known RTT drives the
+// predicted distance toward that RTT, which is the algorithm's whole job.
+func TestCoordinateUpdateConverges(t *testing.T) {
+	other := NewCoordinate()
+	other.Error = 0 // a perfectly confident, fixed reference point
+
+	c := NewCoordinate()
+	const rtt = 0.080 // seconds
+
+	var lastErr float64
+	for i := 0; i < 200; i++ {
+		c.update(other, rtt)
+		lastErr = math.Abs(c.distanceTo(other) - rtt)
+	}
+
+	if lastErr > 0.005 {
+		t.Fatalf("distance to reference after convergence off by %vs, want < 5ms", lastErr)
+	}
+}
+
+func TestCoordinateUpdateIgnoresNonPositiveRTT(t *testing.T) {
+	c := NewCoordinate()
+	before := c.snapshot()
+
+	c.update(NewCoordinate(), 0)
+	c.update(NewCoordinate(), -time.Millisecond.Seconds())
+
+	after := c.snapshot()
+	if euclidean(before.vec, after.vec) != 0 || before.errVal != after.errVal {
+		t.Fatalf("update with non-positive RTT mutated the coordinate: before %+v, after %+v", before, after)
+	}
+}
+
+func TestParseCoordHeader(t *testing.T) {
+	coord, err := parseCoordHeader("1,2,3,4,5,6,7,8;0.25")
+	if err != nil {
+		t.Fatalf("parseCoordHeader returned error: %v", err)
+	}
+	want := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	for i, v := range want {
+		if coord.Vec[i] != v {
+			t.Errorf("Vec[%d] = %v, want %v", i, coord.Vec[i], v)
+		}
+	}
+	if coord.Height != 0.25 {
+		t.Errorf("Height = %v, want 0.25", coord.Height)
+	}
+	if coord.Error != 1.0 {
+		t.Errorf("Error = %v, want 1.0 (max uncertainty)", coord.Error)
+	}
+}
+
+func TestParseCoordHeaderClampsNegativeHeight(t *testing.T) {
+	coord, err := parseCoordHeader("0,0;-1")
+	if err != nil {
+		t.Fatalf("parseCoordHeader returned error: %v", err)
+	}
+	if coord.Height != 0 {
+		t.Errorf("Height = %v, want clamped to 0", coord.Height)
+	}
+}
+
+func TestParseCoordHeaderRejectsMalformedInput(t *testing.T) {
+	cases := []string{
+		"",
+		"1,2,3",           // missing ";height"
+		"1,2,x;0.1",       // non-numeric vector component
+		"1,2,3;notafloat", // non-numeric height
+	}
+	for _, header := range cases {
+		if _, err := parseCoordHeader(header); err == nil {
+			t.Errorf("parseCoordHeader(%q) = nil error, want an error", header)
+		}
+	}
+}